@@ -0,0 +1,64 @@
+package osecure
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPermissionsFromClaims(t *testing.T) {
+	cases := []struct {
+		name  string
+		claim string
+		value interface{}
+		want  []string
+	}{
+		{"missing claim", "roles", nil, []string{}},
+		{"string array", "roles", []interface{}{"read", "write"}, []string{"read", "write"}},
+		{"space separated string", "scope", "read write", []string{"read", "write"}},
+		{"non-string array entries are dropped", "roles", []interface{}{"read", 42}, []string{"read"}},
+		{"unexpected type", "roles", 42, []string{}},
+	}
+
+	for _, c := range cases {
+		claims := map[string]interface{}{}
+		if c.value != nil {
+			claims[c.claim] = c.value
+		}
+
+		got := permissionsFromClaims(claims, c.claim)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: permissionsFromClaims() = %v, want %v", c.name, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: permissionsFromClaims() = %v, want %v", c.name, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestBearerTokenFromRequest(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"no header", "", ""},
+		{"bearer token", "Bearer abc.def.ghi", "abc.def.ghi"},
+		{"case-insensitive prefix", "bearer abc.def.ghi", "abc.def.ghi"},
+		{"basic auth is not bearer", "Basic dXNlcjpwYXNz", ""},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+
+		if got := bearerTokenFromRequest(req); got != c.want {
+			t.Errorf("%s: bearerTokenFromRequest() = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
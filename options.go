@@ -0,0 +1,90 @@
+package osecure
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Option configures an OAuthSession at construction time. See
+// WithErrorHandler, WithLogger, WithSessionStore, and WithHTTPClient.
+type Option func(*OAuthSession)
+
+// ErrorHandler is called for any internal failure instead of letting it
+// crash the request. The default logs via the configured Logger and
+// responds with a generic 500.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+// Logger is satisfied by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+func defaultLogger() Logger {
+	return log.New(os.Stderr, "osecure: ", log.LstdFlags)
+}
+
+// WithErrorHandler overrides how internal errors are reported to the client.
+func WithErrorHandler(h ErrorHandler) Option {
+	return func(s *OAuthSession) {
+		s.errorHandler = h
+	}
+}
+
+// WithLogger overrides where traced permission fetches and internal errors
+// are logged.
+func WithLogger(l Logger) Option {
+	return func(s *OAuthSession) {
+		s.logger = l
+	}
+}
+
+// WithSessionStore overrides the SessionStore passed to NewOAuthSession.
+func WithSessionStore(store SessionStore) Option {
+	return func(s *OAuthSession) {
+		s.sessionStore = store
+	}
+}
+
+// WithHTTPClient overrides the http.Client used to fetch permissions.
+// Requests through it are still traced via the configured Logger.
+func WithHTTPClient(c *http.Client) Option {
+	return func(s *OAuthSession) {
+		s.httpClient = c
+	}
+}
+
+// loggingHTTPClient returns a client equivalent to s.httpClient, except its
+// transport traces each request's method, URL, status and latency via
+// s.logger.
+func (s *OAuthSession) loggingHTTPClient() *http.Client {
+	transport := s.httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	return &http.Client{
+		Transport: &loggingRoundTripper{next: transport, logger: s.logger},
+		Timeout:   s.httpClient.Timeout,
+	}
+}
+
+type loggingRoundTripper struct {
+	next   http.RoundTripper
+	logger Logger
+}
+
+func (t *loggingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	latency := time.Since(start)
+
+	if err != nil {
+		t.logger.Printf("%s %s failed after %s: %v", req.Method, req.URL, latency, err)
+		return resp, err
+	}
+
+	t.logger.Printf("%s %s -> %d (%s)", req.Method, req.URL, resp.StatusCode, latency)
+	return resp, err
+}
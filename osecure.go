@@ -1,15 +1,15 @@
 package osecure
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/gob"
-	"encoding/json"
 	"errors"
-	"github.com/gorilla/sessions"
-	"golang.org/x/oauth2"
 	"net/http"
 	"sort"
 	"time"
+
+	"github.com/gorilla/securecookie"
+	"golang.org/x/oauth2"
 )
 
 var (
@@ -52,7 +52,11 @@ func NewAuthSessionData(token oauth2.Token) *AuthSessionData {
 }
 
 func (data *AuthSessionData) IsExpired() bool {
-	return data.ExpireAt.Before(time.Now())
+	if data.ExpireAt.Before(time.Now()) {
+		return true
+	}
+
+	return !data.Token.Expiry.IsZero() && data.Token.Expiry.Before(time.Now())
 }
 
 func (data *AuthSessionData) IsPermExpired() bool {
@@ -60,13 +64,24 @@ func (data *AuthSessionData) IsPermExpired() bool {
 }
 
 type OAuthSession struct {
-	name           string
-	cookieStore    *sessions.CookieStore
-	client         *oauth2.Config
-	permissionsURL string
+	name                string
+	sessionStore        SessionStore
+	client              *oauth2.Config
+	permissionsProvider PermissionsProvider
+	errorHandler        ErrorHandler
+	logger              Logger
+	httpClient          *http.Client
+	bearerVerifier      *bearerVerifier
+	whitelistDomains    []string
+	stateCodecs         []securecookie.Codec
 }
 
-func NewOAuthSession(name string, oauthConf *OAuthConfig, cookieConf *CookieConfig, callbackURL string) *OAuthSession {
+// NewOAuthSession builds an OAuthSession backed by sessionStore, which may
+// be NewCookieSessionStore, NewFilesystemSessionStore, NewRedisSessionStore,
+// or any other SessionStore implementation. Behavior can be further
+// customized with options such as WithErrorHandler, WithLogger,
+// WithHTTPClient, and WithPermissionsProvider.
+func NewOAuthSession(name string, oauthConf *OAuthConfig, sessionStore SessionStore, callbackURL string, opts ...Option) *OAuthSession {
 
 	client := &oauth2.Config{
 		ClientID:     oauthConf.ClientID,
@@ -77,17 +92,31 @@ func NewOAuthSession(name string, oauthConf *OAuthConfig, cookieConf *CookieConf
 		},
 		RedirectURL: callbackURL,
 	}
-	return &OAuthSession{
-		name:           name,
-		cookieStore:    newCookieStore(cookieConf),
-		client:         client,
-		permissionsURL: oauthConf.PermissionsURL,
+
+	s := &OAuthSession{
+		name:                name,
+		sessionStore:        sessionStore,
+		client:              client,
+		permissionsProvider: NewJSONEndpointPermissionsProvider(oauthConf.PermissionsURL),
+		logger:              defaultLogger(),
+		httpClient:          http.DefaultClient,
+		stateCodecs:         securecookie.CodecsFromPairs(securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32)),
+	}
+
+	for _, opt := range opts {
+		opt(s)
 	}
+
+	return s
 }
 
 func (s *OAuthSession) Secured(h http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		if !s.isAuthorized(r) {
+		data, handled := s.ensureValidSession(w, r)
+		if handled {
+			return
+		}
+		if data == nil {
 			s.startOAuth(w, r)
 			return
 		}
@@ -96,63 +125,131 @@ func (s *OAuthSession) Secured(h http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
-func (s *OAuthSession) isAuthorized(r *http.Request) bool {
-	data := s.getAuthSessionDataFromRequest(r)
-	if data == nil || data.IsExpired() {
-		return false
+// ensureValidSession resolves the AuthSessionData for r: if a bearer token
+// is present and OIDC bearer auth is configured, it is verified and mapped
+// into an AuthSessionData directly, bypassing the SessionStore entirely.
+// Otherwise it loads the cookie session, transparently refreshing the
+// access token (and re-issuing the cookie) if it has expired but a refresh
+// token is available. It returns a nil data with handled false if there is
+// no session or it couldn't be refreshed, in which case the caller should
+// fall back to startOAuth. handled is true if the request was already
+// responded to (an invalid bearer token, or an internal error reported via
+// the ErrorHandler), and the caller must not write to w itself.
+func (s *OAuthSession) ensureValidSession(w http.ResponseWriter, r *http.Request) (data *AuthSessionData, handled bool) {
+	if s.bearerVerifier != nil {
+		if raw := bearerTokenFromRequest(r); raw != "" {
+			data, err := s.bearerVerifier.verify(r.Context(), raw)
+			if err != nil {
+				http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+				return nil, true
+			}
+			return data, false
+		}
 	}
 
-	return true
-}
+	data, err := s.getAuthSessionDataFromRequest(r)
+	if err != nil {
+		s.handleError(w, r, err)
+		return nil, true
+	}
+	if data == nil {
+		return nil, false
+	}
 
-func (s *OAuthSession) ensurePermUpdated(w http.ResponseWriter, r *http.Request, data *AuthSessionData) {
-	if !data.IsPermExpired() {
-		return
+	if data.IsExpired() {
+		ok, err := s.refreshToken(w, r, data)
+		if err != nil {
+			s.handleError(w, r, err)
+			return nil, true
+		}
+		if !ok {
+			return nil, false
+		}
 	}
 
-	client := oauth2.NewClient(oauth2.NoContext, oauth2.StaticTokenSource(&data.Token))
+	return data, false
+}
 
-	resp, err := client.Get(s.permissionsURL)
+// refreshToken attempts to obtain a new access token using data.Token's
+// refresh token, updating data and re-issuing the cookie on success. It
+// returns ok=false (leaving data untouched) if there is no refresh token or
+// the refresh request fails, in which case the caller should fall back to
+// startOAuth. A non-nil error means issuing the refreshed cookie itself
+// failed; it is returned to the caller, not passed to the ErrorHandler here.
+func (s *OAuthSession) refreshToken(w http.ResponseWriter, r *http.Request, data *AuthSessionData) (ok bool, err error) {
+	if data.Token.RefreshToken == "" {
+		return false, nil
+	}
+
+	newToken, err := s.client.TokenSource(oauth2.NoContext, &data.Token).Token()
 	if err != nil {
-		panic(err)
+		return false, nil
 	}
 
-	var result struct {
-		Permissions []string `json:"permissions"`
+	data.Token = *newToken
+	data.ExpireAt = time.Now().Add(time.Duration(SessionExpireTime) * time.Second)
+
+	if err := s.issueAuthCookie(w, r, data); err != nil {
+		return false, err
 	}
-	err = json.NewDecoder(resp.Body).Decode(&result)
+
+	return true, nil
+}
+
+// ensurePermUpdated refreshes data.Permissions if they have expired. Unlike
+// ensureValidSession, it never writes to w on error: GetPermissions and
+// HasPermission are meant to be called from within the caller's own
+// handler, which is still free to write its own response, so the error is
+// only ever returned, never routed to the ErrorHandler here.
+func (s *OAuthSession) ensurePermUpdated(w http.ResponseWriter, r *http.Request, data *AuthSessionData) error {
+	if !data.IsPermExpired() {
+		return nil
+	}
+
+	if data.Token.Expiry.Before(time.Now()) && data.Token.RefreshToken != "" {
+		if _, err := s.refreshToken(w, r, data); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.WithValue(oauth2.NoContext, oauth2.HTTPClient, s.loggingHTTPClient())
+
+	permissions, err := s.permissionsProvider.Fetch(ctx, &data.Token)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	data.Permissions = result.Permissions
+	data.Permissions = permissions
 	data.PermExpireAt = time.Now().Add(time.Duration(PermissionExpireTime) * time.Second)
 
 	// Sort the string, as sort.SearchStrings needs sorted []string.
 	sort.Strings(data.Permissions)
 
-	s.issueAuthCookie(w, r, data)
-	return
+	return s.issueAuthCookie(w, r, data)
 }
 
 func (s *OAuthSession) GetPermissions(w http.ResponseWriter, r *http.Request) ([]string, error) {
-	data := s.getAuthSessionDataFromRequest(r)
-	if data == nil || data.IsExpired() {
+	data, handled := s.ensureValidSession(w, r)
+	if handled || data == nil {
 		return nil, errors.New("invalid session")
 	}
 
-	s.ensurePermUpdated(w, r, data)
+	if err := s.ensurePermUpdated(w, r, data); err != nil {
+		return nil, err
+	}
 
 	return data.Permissions, nil
 }
 
 func (s *OAuthSession) HasPermission(w http.ResponseWriter, r *http.Request, permission string) bool {
-	data := s.getAuthSessionDataFromRequest(r)
-	if data == nil || data.IsExpired() {
+	data, handled := s.ensureValidSession(w, r)
+	if handled || data == nil {
 		return false
 	}
 
-	s.ensurePermUpdated(w, r, data)
+	if err := s.ensurePermUpdated(w, r, data); err != nil {
+		return false
+	}
 
 	perms := data.Permissions
 
@@ -162,34 +259,23 @@ func (s *OAuthSession) HasPermission(w http.ResponseWriter, r *http.Request, per
 	return result
 }
 
-func (s *OAuthSession) getAuthSessionDataFromRequest(r *http.Request) *AuthSessionData {
-	session, err := s.cookieStore.Get(r, s.name)
-	if err != nil {
-		panic(err)
-	}
-
-	v, found := session.Values["data"]
-	if !found {
-		return nil
-	}
-
-	data, ok := v.(*AuthSessionData)
-	if !ok {
-		return nil
-	}
-
-	return data
-
-}
-
-func (s *OAuthSession) startOAuth(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, s.client.AuthCodeURL(r.RequestURI), 303)
+func (s *OAuthSession) getAuthSessionDataFromRequest(r *http.Request) (*AuthSessionData, error) {
+	return s.sessionStore.Load(r, s.name)
 }
 
 func (s *OAuthSession) CallbackView(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 	code := q.Get("code")
-	cont := q.Get("state")
+	state := q.Get("state")
+
+	cont, ok := s.verifyOAuthState(w, r, state)
+	if !ok {
+		http.Error(w, "invalid or expired oauth state", http.StatusBadRequest)
+		return
+	}
+	if !s.IsValidRedirect(cont) {
+		cont = "/"
+	}
 
 	jr, err := s.client.Exchange(oauth2.NoContext, code)
 
@@ -197,33 +283,27 @@ func (s *OAuthSession) CallbackView(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), 400)
 		return
 	}
-	s.issueAuthCookie(w, r, NewAuthSessionData(*jr))
-	http.Redirect(w, r, cont, 303)
-}
 
-func (s *OAuthSession) issueAuthCookie(w http.ResponseWriter, r *http.Request, data *AuthSessionData) {
-	session, err := s.cookieStore.Get(r, s.name)
-	if err != nil {
-		panic(err)
+	if err := s.issueAuthCookie(w, r, NewAuthSessionData(*jr)); err != nil {
+		s.handleError(w, r, err)
+		return
 	}
-	session.Values["data"] = data
-	session.Save(r, w)
+	http.Redirect(w, r, cont, 303)
 }
 
-func newCookieStore(conf *CookieConfig) *sessions.CookieStore {
-
-	var signingKey, encryptionKey []byte
-	var err error
-
-	signingKey, err = base64.StdEncoding.DecodeString(conf.SigningKey)
-	if err != nil {
-		panic(err)
-	}
+func (s *OAuthSession) issueAuthCookie(w http.ResponseWriter, r *http.Request, data *AuthSessionData) error {
+	return s.sessionStore.Save(w, r, s.name, data)
+}
 
-	encryptionKey, err = base64.StdEncoding.DecodeString(conf.EncryptionKey)
-	if err != nil {
-		panic(err)
+// handleError routes an internal error to s.errorHandler if one was
+// configured via WithErrorHandler, or otherwise logs it via s.logger and
+// responds with a generic 500.
+func (s *OAuthSession) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	if s.errorHandler != nil {
+		s.errorHandler(w, r, err)
+		return
 	}
 
-	return sessions.NewCookieStore(signingKey, encryptionKey)
+	s.logger.Printf("internal error handling %s %s: %v", r.Method, r.URL, err)
+	http.Error(w, "internal server error", http.StatusInternalServerError)
 }
@@ -0,0 +1,30 @@
+package osecure
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestAuthSessionDataIsExpired(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+
+	cases := []struct {
+		name     string
+		data     AuthSessionData
+		expected bool
+	}{
+		{"fresh", AuthSessionData{ExpireAt: future, Token: oauth2.Token{Expiry: future}}, false},
+		{"session expired", AuthSessionData{ExpireAt: past, Token: oauth2.Token{Expiry: future}}, true},
+		{"token expired", AuthSessionData{ExpireAt: future, Token: oauth2.Token{Expiry: past}}, true},
+		{"no token expiry set", AuthSessionData{ExpireAt: future}, false},
+	}
+
+	for _, c := range cases {
+		if got := c.data.IsExpired(); got != c.expected {
+			t.Errorf("%s: IsExpired() = %v, want %v", c.name, got, c.expected)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package osecure
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+// PermissionsProvider resolves the set of permissions granted to token.
+// OAuthSession calls Fetch whenever AuthSessionData.PermExpireAt has
+// passed, so implementations are free to cache or rate-limit internally.
+type PermissionsProvider interface {
+	Fetch(ctx context.Context, token *oauth2.Token) ([]string, error)
+}
+
+// WithPermissionsProvider overrides how permissions are (re)fetched once
+// AuthSessionData.PermExpireAt passes. The default, set from
+// OAuthConfig.PermissionsURL, is NewJSONEndpointPermissionsProvider.
+func WithPermissionsProvider(p PermissionsProvider) Option {
+	return func(s *OAuthSession) {
+		s.permissionsProvider = p
+	}
+}
+
+// jsonEndpointPermissionsProvider is the original behavior: GET a URL with
+// the access token attached and decode a {"permissions": [...]} response.
+type jsonEndpointPermissionsProvider struct {
+	url string
+}
+
+// NewJSONEndpointPermissionsProvider fetches permissions from url, which
+// must respond with {"permissions": ["...", ...]}.
+func NewJSONEndpointPermissionsProvider(url string) PermissionsProvider {
+	return &jsonEndpointPermissionsProvider{url: url}
+}
+
+func (p *jsonEndpointPermissionsProvider) Fetch(ctx context.Context, token *oauth2.Token) ([]string, error) {
+	client := oauth2.NewClient(ctx, oauth2.StaticTokenSource(token))
+
+	resp, err := client.Get(p.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Permissions, nil
+}
+
+// oidcClaimsPermissionsProvider reads permissions out of a claim in the
+// OIDC UserInfo response, for providers that don't expose a dedicated
+// permissions endpoint.
+type oidcClaimsPermissionsProvider struct {
+	provider *oidc.Provider
+	claim    string
+}
+
+// NewOIDCClaimsPermissionsProvider fetches permissions from claim (default
+// "roles" if empty) in the UserInfo response of the OIDC provider at
+// issuerURL.
+func NewOIDCClaimsPermissionsProvider(ctx context.Context, issuerURL, claim string) (PermissionsProvider, error) {
+	provider, err := oidc.NewProvider(ctx, issuerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if claim == "" {
+		claim = "roles"
+	}
+
+	return &oidcClaimsPermissionsProvider{provider: provider, claim: claim}, nil
+}
+
+func (p *oidcClaimsPermissionsProvider) Fetch(ctx context.Context, token *oauth2.Token) ([]string, error) {
+	userInfo, err := p.provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := userInfo.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	permissions := permissionsFromClaims(claims, p.claim)
+	sort.Strings(permissions)
+
+	return permissions, nil
+}
+
+// StaticPermissionsProvider always returns the same permissions regardless
+// of token, handy for tests.
+type StaticPermissionsProvider []string
+
+func (p StaticPermissionsProvider) Fetch(ctx context.Context, token *oauth2.Token) ([]string, error) {
+	return []string(p), nil
+}
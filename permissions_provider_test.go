@@ -0,0 +1,43 @@
+package osecure
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestHasPermissionWithStaticPermissionsProvider(t *testing.T) {
+	store, err := NewCookieSessionStore(testCookieConfig())
+	if err != nil {
+		t.Fatalf("NewCookieSessionStore: %v", err)
+	}
+
+	s := NewOAuthSession(
+		"osecure-test",
+		&OAuthConfig{},
+		store,
+		"https://example.com/callback",
+		WithPermissionsProvider(StaticPermissionsProvider{"read", "write"}),
+	)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	if err := s.issueAuthCookie(rec, req, NewAuthSessionData(oauth2.Token{AccessToken: "test-token"})); err != nil {
+		t.Fatalf("issueAuthCookie: %v", err)
+	}
+
+	loggedIn := httptest.NewRequest("GET", "/", nil)
+	for _, c := range rec.Result().Cookies() {
+		loggedIn.AddCookie(c)
+	}
+
+	w := httptest.NewRecorder()
+
+	if !s.HasPermission(w, loggedIn, "read") {
+		t.Error(`HasPermission(loggedIn, "read") = false, want true`)
+	}
+	if s.HasPermission(w, loggedIn, "admin") {
+		t.Error(`HasPermission(loggedIn, "admin") = true, want false`)
+	}
+}
@@ -0,0 +1,162 @@
+package osecure
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisTicket is all that ever reaches the browser for a Redis-backed
+// session: which server-side entry to look up, and a per-session secret
+// that must match the one stored alongside it. It travels inside a normal
+// signed+encrypted cookie, so the secret only guards against a
+// stolen/replayed session id on its own.
+type redisTicket struct {
+	SessionID string
+	Secret    string
+}
+
+// redisSessionStore keeps the gob-encoded AuthSessionData blob in Redis,
+// keyed by a random session id, and only puts a small signed ticket in the
+// cookie itself. The blob is stored in Redis as is; it is not encrypted.
+type redisSessionStore struct {
+	pool          *redis.Pool
+	ticketStore   *sessions.CookieStore
+	keyPrefix     string
+	sessionMaxAge time.Duration
+}
+
+// NewRedisSessionStore builds a SessionStore that stores AuthSessionData in
+// Redis via pool, keyed under keyPrefix. It returns an error if conf's keys
+// aren't valid base64.
+func NewRedisSessionStore(pool *redis.Pool, conf *CookieConfig, keyPrefix string) (SessionStore, error) {
+	ticketStore, err := newGorillaCookieStore(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &redisSessionStore{
+		pool:          pool,
+		ticketStore:   ticketStore,
+		keyPrefix:     keyPrefix,
+		sessionMaxAge: time.Duration(SessionExpireTime) * time.Second,
+	}, nil
+}
+
+func (rs *redisSessionStore) Save(w http.ResponseWriter, r *http.Request, name string, data *AuthSessionData) error {
+	// Get returns a new, usable session even when it fails to decode the
+	// incoming cookie (tampered, expired, or stale e.g. after key
+	// rotation), so a bad existing cookie must not stop a new one from
+	// being issued.
+	session, _ := rs.ticketStore.Get(r, name)
+
+	ticket, ok := rs.ticketFromSession(session)
+	if !ok {
+		ticket = redisTicket{SessionID: newRandomID(), Secret: newRandomID()}
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		return err
+	}
+
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	entry := struct {
+		Secret string
+		Blob   []byte
+	}{Secret: ticket.Secret, Blob: buf.Bytes()}
+
+	var entryBuf bytes.Buffer
+	if err := gob.NewEncoder(&entryBuf).Encode(entry); err != nil {
+		return err
+	}
+
+	key := rs.key(ticket.SessionID)
+	if _, err := conn.Do("SETEX", key, int(rs.sessionMaxAge.Seconds()), entryBuf.Bytes()); err != nil {
+		return err
+	}
+
+	session.Values["ticket"] = ticket
+	return session.Save(r, w)
+}
+
+func (rs *redisSessionStore) Load(r *http.Request, name string) (*AuthSessionData, error) {
+	session, err := rs.ticketStore.Get(r, name)
+	if err != nil {
+		// Tampered, expired, or stale (e.g. key rotation) cookie: treat it
+		// the same as no session rather than erroring the request.
+		return nil, nil
+	}
+
+	ticket, ok := rs.ticketFromSession(session)
+	if !ok {
+		return nil, nil
+	}
+
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	blob, err := redis.Bytes(conn.Do("GET", rs.key(ticket.SessionID)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entry struct {
+		Secret string
+		Blob   []byte
+	}
+	if err := gob.NewDecoder(bytes.NewReader(blob)).Decode(&entry); err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(entry.Secret), []byte(ticket.Secret)) != 1 {
+		// Session id reused or ticket forged across secrets; treat as no session.
+		return nil, nil
+	}
+
+	var data AuthSessionData
+	if err := gob.NewDecoder(bytes.NewReader(entry.Blob)).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
+
+func (rs *redisSessionStore) Clear(w http.ResponseWriter, r *http.Request, name string) error {
+	session, _ := rs.ticketStore.Get(r, name)
+
+	if ticket, ok := rs.ticketFromSession(session); ok {
+		conn := rs.pool.Get()
+		defer conn.Close()
+		if _, err := conn.Do("DEL", rs.key(ticket.SessionID)); err != nil {
+			return err
+		}
+	}
+
+	session.Options.MaxAge = -1
+	return session.Save(r, w)
+}
+
+func (rs *redisSessionStore) ticketFromSession(session *sessions.Session) (redisTicket, bool) {
+	v, found := session.Values["ticket"]
+	if !found {
+		return redisTicket{}, false
+	}
+	ticket, ok := v.(redisTicket)
+	return ticket, ok
+}
+
+func (rs *redisSessionStore) key(sessionID string) string {
+	return fmt.Sprintf("%s%s", rs.keyPrefix, sessionID)
+}
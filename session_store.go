@@ -0,0 +1,255 @@
+package osecure
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// MaxCookieSize caps how large (in bytes) a single cookie written by
+// cookieSessionStore may get before it is split into numbered chunk
+// cookies (name_0, name_1, ...).
+var MaxCookieSize = 3900
+
+// SessionStore abstracts where an *AuthSessionData is persisted between
+// requests: the cookie itself, the filesystem, Redis, ...
+type SessionStore interface {
+	// Save persists data and writes whatever cookie(s) Load needs to find
+	// it again on a later request.
+	Save(w http.ResponseWriter, r *http.Request, name string, data *AuthSessionData) error
+
+	// Load returns a nil *AuthSessionData (and no error) if there is no
+	// session.
+	Load(r *http.Request, name string) (*AuthSessionData, error)
+
+	// Clear removes any stored data and cookies for name, logging the user out.
+	Clear(w http.ResponseWriter, r *http.Request, name string) error
+}
+
+// cookieSessionStore is the original behavior: the whole AuthSessionData is
+// gob-encoded, signed and encrypted straight into the cookie, split across
+// numbered chunk cookies once it outgrows MaxCookieSize.
+type cookieSessionStore struct {
+	store *sessions.CookieStore
+}
+
+// NewCookieSessionStore builds the default SessionStore. It returns an
+// error if conf's keys aren't valid base64.
+func NewCookieSessionStore(conf *CookieConfig) (SessionStore, error) {
+	store, err := newGorillaCookieStore(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// The chunking below happens after EncodeMulti already produced the
+	// full value, so securecookie's own default 4096-byte MaxLength would
+	// reject exactly the large sessions chunking exists for. Chunking is
+	// the size limit here instead.
+	for _, codec := range store.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxLength(0)
+		}
+	}
+
+	return &cookieSessionStore{store: store}, nil
+}
+
+func (cs *cookieSessionStore) Save(w http.ResponseWriter, r *http.Request, name string, data *AuthSessionData) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(name, buf.Bytes(), cs.store.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	chunks := splitCookieValue(name, encoded, MaxCookieSize)
+
+	opts := cs.store.Options
+	for i, value := range chunks {
+		http.SetCookie(w, &http.Cookie{
+			Name:     chunkCookieName(name, i),
+			Value:    value,
+			Path:     opts.Path,
+			Domain:   opts.Domain,
+			MaxAge:   opts.MaxAge,
+			Secure:   opts.Secure,
+			HttpOnly: opts.HttpOnly,
+		})
+	}
+
+	return cs.clearChunksFrom(w, r, name, len(chunks))
+}
+
+func (cs *cookieSessionStore) Load(r *http.Request, name string) (*AuthSessionData, error) {
+	encoded, found := readCookieChunks(r, name)
+	if !found {
+		return nil, nil
+	}
+
+	var blob []byte
+	if err := securecookie.DecodeMulti(name, encoded, &blob, cs.store.Codecs...); err != nil {
+		// Tampered, expired, or stale (e.g. key rotation) cookie: treat it
+		// the same as no session rather than erroring the request.
+		return nil, nil
+	}
+
+	var data AuthSessionData
+	if err := gob.NewDecoder(bytes.NewReader(blob)).Decode(&data); err != nil {
+		return nil, nil
+	}
+
+	return &data, nil
+}
+
+func (cs *cookieSessionStore) Clear(w http.ResponseWriter, r *http.Request, name string) error {
+	return cs.clearChunksFrom(w, r, name, 0)
+}
+
+// clearChunksFrom expires any chunk cookies numbered keep and above that
+// are present on r.
+func (cs *cookieSessionStore) clearChunksFrom(w http.ResponseWriter, r *http.Request, name string, keep int) error {
+	opts := cs.store.Options
+	for i := keep; ; i++ {
+		cookieName := chunkCookieName(name, i)
+		if _, err := r.Cookie(cookieName); err == http.ErrNoCookie {
+			break
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:   cookieName,
+			Value:  "",
+			Path:   opts.Path,
+			Domain: opts.Domain,
+			MaxAge: -1,
+		})
+	}
+	return nil
+}
+
+// readCookieChunks concatenates every name_0, name_1, ... cookie on r back
+// into the value they were split from.
+func readCookieChunks(r *http.Request, name string) (value string, found bool) {
+	var buf bytes.Buffer
+	for i := 0; ; i++ {
+		c, err := r.Cookie(chunkCookieName(name, i))
+		if err == http.ErrNoCookie {
+			break
+		}
+		buf.WriteString(c.Value)
+		found = true
+	}
+	return buf.String(), found
+}
+
+func chunkCookieName(name string, i int) string {
+	return fmt.Sprintf("%s_%d", name, i)
+}
+
+// splitCookieValue splits value into chunks no larger than maxCookieSize,
+// reserving room for the numbered cookie name (name_<i>) itself.
+func splitCookieValue(name, value string, maxCookieSize int) []string {
+	nameOverhead := len(chunkCookieName(name, 999))
+	chunkSize := maxCookieSize - nameOverhead
+	if chunkSize <= 0 {
+		chunkSize = maxCookieSize
+	}
+
+	if len(value) == 0 {
+		return []string{""}
+	}
+
+	var chunks []string
+	for len(value) > 0 {
+		n := chunkSize
+		if n > len(value) {
+			n = len(value)
+		}
+		chunks = append(chunks, value[:n])
+		value = value[n:]
+	}
+	return chunks
+}
+
+// filesystemSessionStore keeps AuthSessionData in files on disk, with only
+// a signed and encrypted session id in the cookie.
+type filesystemSessionStore struct {
+	store *sessions.FilesystemStore
+}
+
+// NewFilesystemSessionStore builds a SessionStore that keeps AuthSessionData
+// in files under path. It returns an error if conf's keys aren't valid base64.
+func NewFilesystemSessionStore(path string, conf *CookieConfig) (SessionStore, error) {
+	signingKey, encryptionKey, err := decodeCookieKeys(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &filesystemSessionStore{
+		store: sessions.NewFilesystemStore(path, signingKey, encryptionKey),
+	}, nil
+}
+
+func (fs *filesystemSessionStore) Save(w http.ResponseWriter, r *http.Request, name string, data *AuthSessionData) error {
+	// Get returns a new, usable session even when it fails to decode the
+	// incoming cookie (tampered, expired, or stale e.g. after key
+	// rotation), so a bad existing cookie must not stop a new one from
+	// being issued.
+	session, _ := fs.store.Get(r, name)
+	session.Values["data"] = data
+	return session.Save(r, w)
+}
+
+func (fs *filesystemSessionStore) Load(r *http.Request, name string) (*AuthSessionData, error) {
+	session, err := fs.store.Get(r, name)
+	if err != nil {
+		// Tampered, expired, or stale (e.g. key rotation) cookie: treat it
+		// the same as no session rather than erroring the request.
+		return nil, nil
+	}
+
+	v, found := session.Values["data"]
+	if !found {
+		return nil, nil
+	}
+
+	data, ok := v.(*AuthSessionData)
+	if !ok {
+		return nil, nil
+	}
+
+	return data, nil
+}
+
+func (fs *filesystemSessionStore) Clear(w http.ResponseWriter, r *http.Request, name string) error {
+	session, _ := fs.store.Get(r, name)
+	session.Options.MaxAge = -1
+	return session.Save(r, w)
+}
+
+func newGorillaCookieStore(conf *CookieConfig) (*sessions.CookieStore, error) {
+	signingKey, encryptionKey, err := decodeCookieKeys(conf)
+	if err != nil {
+		return nil, err
+	}
+	return sessions.NewCookieStore(signingKey, encryptionKey), nil
+}
+
+func decodeCookieKeys(conf *CookieConfig) (signingKey, encryptionKey []byte, err error) {
+	signingKey, err = base64.StdEncoding.DecodeString(conf.SigningKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encryptionKey, err = base64.StdEncoding.DecodeString(conf.EncryptionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return signingKey, encryptionKey, nil
+}
@@ -0,0 +1,240 @@
+package osecure
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func testCookieConfig() *CookieConfig {
+	return &CookieConfig{
+		SigningKey:    "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+		EncryptionKey: "MDEyMzQ1Njc4OWFiY2RlZg==",
+	}
+}
+
+// testSessionStoreConformance exercises the behavior every SessionStore
+// implementation must provide, regardless of where the data actually lives.
+func testSessionStoreConformance(t *testing.T, store SessionStore) {
+	const name = "osecure-test"
+
+	req := httptest.NewRequest("GET", "/", nil)
+	data, err := store.Load(req, name)
+	if err != nil {
+		t.Fatalf("Load on empty session: %v", err)
+	}
+	if data != nil {
+		t.Fatalf("Load on empty session: expected nil, got %+v", data)
+	}
+
+	saved := NewAuthSessionData(oauth2.Token{AccessToken: "test-token"})
+	saved.Permissions = []string{"read", "write"}
+
+	rec := httptest.NewRecorder()
+	if err := store.Save(rec, req, name, saved); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	req2 := httptest.NewRequest("GET", "/", nil)
+	for _, c := range rec.Result().Cookies() {
+		req2.AddCookie(c)
+	}
+
+	loaded, err := store.Load(req2, name)
+	if err != nil {
+		t.Fatalf("Load after Save: %v", err)
+	}
+	if loaded == nil {
+		t.Fatal("Load after Save: expected data, got nil")
+	}
+	if len(loaded.Permissions) != 2 || loaded.Permissions[0] != "read" || loaded.Permissions[1] != "write" {
+		t.Fatalf("Load after Save: unexpected permissions %+v", loaded.Permissions)
+	}
+
+	rec2 := httptest.NewRecorder()
+	if err := store.Clear(rec2, req2, name); err != nil {
+		t.Fatalf("Clear: %v", err)
+	}
+
+	req3 := httptest.NewRequest("GET", "/", nil)
+	for _, c := range rec2.Result().Cookies() {
+		req3.AddCookie(c)
+	}
+
+	cleared, err := store.Load(req3, name)
+	if err != nil {
+		t.Fatalf("Load after Clear: %v", err)
+	}
+	if cleared != nil {
+		t.Fatalf("Load after Clear: expected nil, got %+v", cleared)
+	}
+}
+
+func TestCookieSessionStore(t *testing.T) {
+	store, err := NewCookieSessionStore(testCookieConfig())
+	if err != nil {
+		t.Fatalf("NewCookieSessionStore: %v", err)
+	}
+	testSessionStoreConformance(t, store)
+}
+
+func TestFilesystemSessionStore(t *testing.T) {
+	store, err := NewFilesystemSessionStore(t.TempDir(), testCookieConfig())
+	if err != nil {
+		t.Fatalf("NewFilesystemSessionStore: %v", err)
+	}
+	testSessionStoreConformance(t, store)
+}
+
+// TestFilesystemSessionStoreToleratesStaleCookie covers logging in again
+// after a tampered/stale cookie (e.g. post key rotation): Load must treat
+// it as no session, and Save must still be able to establish a new one
+// rather than failing because the old cookie didn't decode.
+func TestFilesystemSessionStoreToleratesStaleCookie(t *testing.T) {
+	store, err := NewFilesystemSessionStore(t.TempDir(), testCookieConfig())
+	if err != nil {
+		t.Fatalf("NewFilesystemSessionStore: %v", err)
+	}
+
+	const name = "osecure-test"
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: name, Value: "not-a-valid-session-cookie"})
+
+	data, err := store.Load(req, name)
+	if err != nil {
+		t.Fatalf("Load with a tampered cookie: %v", err)
+	}
+	if data != nil {
+		t.Fatalf("Load with a tampered cookie: expected nil, got %+v", data)
+	}
+
+	saved := NewAuthSessionData(oauth2.Token{AccessToken: "fresh-login"})
+	rec := httptest.NewRecorder()
+	if err := store.Save(rec, req, name, saved); err != nil {
+		t.Fatalf("Save with a tampered existing cookie: %v", err)
+	}
+
+	req2 := httptest.NewRequest("GET", "/", nil)
+	for _, c := range rec.Result().Cookies() {
+		req2.AddCookie(c)
+	}
+
+	loaded, err := store.Load(req2, name)
+	if err != nil {
+		t.Fatalf("Load after Save: %v", err)
+	}
+	if loaded == nil || loaded.Token.AccessToken != "fresh-login" {
+		t.Fatalf("Load after Save: data mismatch, got %+v", loaded)
+	}
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	addr := os.Getenv("OSECURE_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("set OSECURE_TEST_REDIS_ADDR to run the Redis SessionStore conformance test")
+	}
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+	defer pool.Close()
+
+	store, err := NewRedisSessionStore(pool, testCookieConfig(), "osecure-test:")
+	if err != nil {
+		t.Fatalf("NewRedisSessionStore: %v", err)
+	}
+	testSessionStoreConformance(t, store)
+}
+
+func TestDecodeCookieKeysInvalidBase64(t *testing.T) {
+	_, err := NewCookieSessionStore(&CookieConfig{SigningKey: "not-base64!", EncryptionKey: "not-base64!"})
+	if err == nil {
+		t.Fatal("NewCookieSessionStore with invalid base64 keys: expected error, got nil")
+	}
+}
+
+// cookiesFromResponse returns the cookies rec set that a browser would still
+// be holding, i.e. excluding ones just expired via MaxAge < 0.
+func cookiesFromResponse(rec *httptest.ResponseRecorder) []*http.Cookie {
+	var live []*http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.MaxAge < 0 {
+			continue
+		}
+		live = append(live, c)
+	}
+	return live
+}
+
+func TestCookieSessionStoreMultiChunk(t *testing.T) {
+	store, err := NewCookieSessionStore(testCookieConfig())
+	if err != nil {
+		t.Fatalf("NewCookieSessionStore: %v", err)
+	}
+
+	const name = "osecure-test"
+	big := NewAuthSessionData(oauth2.Token{AccessToken: strings.Repeat("x", 10000)})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	if err := store.Save(rec, req, name, big); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	cookies := cookiesFromResponse(rec)
+	if len(cookies) < 2 {
+		t.Fatalf("Save: expected more than one chunk cookie for a large session, got %d", len(cookies))
+	}
+
+	req2 := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		req2.AddCookie(c)
+	}
+
+	loaded, err := store.Load(req2, name)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if loaded == nil || loaded.Token.AccessToken != big.Token.AccessToken {
+		t.Fatalf("Load: data mismatch, got %+v", loaded)
+	}
+
+	// Saving a smaller session afterward must clear the now-stale trailing chunks.
+	small := NewAuthSessionData(oauth2.Token{AccessToken: "small"})
+	rec2 := httptest.NewRecorder()
+	if err := store.Save(rec2, req2, name, small); err != nil {
+		t.Fatalf("Save (shrink): %v", err)
+	}
+
+	var sawClearedChunk bool
+	for _, c := range rec2.Result().Cookies() {
+		if c.Name == chunkCookieName(name, 1) && c.MaxAge < 0 {
+			sawClearedChunk = true
+		}
+	}
+	if !sawClearedChunk {
+		t.Fatalf("Save (shrink): expected the stale %s cookie to be cleared", chunkCookieName(name, 1))
+	}
+
+	req3 := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookiesFromResponse(rec2) {
+		req3.AddCookie(c)
+	}
+
+	loaded2, err := store.Load(req3, name)
+	if err != nil {
+		t.Fatalf("Load (after shrink): %v", err)
+	}
+	if loaded2 == nil || loaded2.Token.AccessToken != "small" {
+		t.Fatalf("Load (after shrink): data mismatch, got %+v", loaded2)
+	}
+}
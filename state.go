@@ -0,0 +1,158 @@
+package osecure
+
+import (
+	"encoding/gob"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+func init() {
+	gob.Register(oauthState{})
+}
+
+// oauthStateCookieName holds the short-lived, signed and encrypted cookie
+// that ties an in-flight OAuth dance back to the request that started it.
+const oauthStateCookieName = "_osecure_state"
+
+// oauthStateMaxAge bounds how long an OAuth callback may arrive after
+// startOAuth issued the state cookie, to limit the window for a stolen or
+// replayed callback.
+const oauthStateMaxAge = 10 * time.Minute
+
+type oauthState struct {
+	Nonce       string
+	OriginalURI string
+	CreatedAt   time.Time
+}
+
+// startOAuth begins the OAuth dance, remembering r's URI (to return to
+// after login) behind a random, unguessable state nonce rather than
+// trusting the client to round-trip it unmodified.
+func (s *OAuthSession) startOAuth(w http.ResponseWriter, r *http.Request) {
+	state := oauthState{
+		Nonce:       newRandomID(),
+		OriginalURI: r.RequestURI,
+		CreatedAt:   time.Now(),
+	}
+
+	encoded, err := s.encodeOAuthState(state)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookieName,
+		Value:    encoded,
+		Path:     "/",
+		MaxAge:   int(oauthStateMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	})
+
+	http.Redirect(w, r, s.client.AuthCodeURL(state.Nonce), 303)
+}
+
+// verifyOAuthState checks the state nonce returned by the provider against
+// the one we stashed in the state cookie, rejecting mismatches and stale
+// callbacks, and clears the cookie either way since it is single-use. On
+// success it returns the original URI to redirect back to.
+func (s *OAuthSession) verifyOAuthState(w http.ResponseWriter, r *http.Request, returnedNonce string) (originalURI string, ok bool) {
+	clearOAuthStateCookie(w)
+
+	cookie, err := r.Cookie(oauthStateCookieName)
+	if err != nil {
+		return "", false
+	}
+
+	state, err := s.decodeOAuthState(cookie.Value)
+	if err != nil {
+		return "", false
+	}
+
+	if state.Nonce != returnedNonce || time.Since(state.CreatedAt) > oauthStateMaxAge {
+		return "", false
+	}
+
+	return state.OriginalURI, true
+}
+
+func clearOAuthStateCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   oauthStateCookieName,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+func (s *OAuthSession) encodeOAuthState(state oauthState) (string, error) {
+	return securecookie.EncodeMulti(oauthStateCookieName, state, s.stateCodecs...)
+}
+
+func (s *OAuthSession) decodeOAuthState(encoded string) (oauthState, error) {
+	var state oauthState
+	err := securecookie.DecodeMulti(oauthStateCookieName, encoded, &state, s.stateCodecs...)
+	return state, err
+}
+
+// WithWhitelistDomains restricts where post-login redirects may point,
+// beyond the OAuthSession's own redirect host. An entry is an exact host
+// ("example.com") or, prefixed with ".", a domain and its subdomains
+// (".example.com").
+func WithWhitelistDomains(domains []string) Option {
+	return func(s *OAuthSession) {
+		s.whitelistDomains = domains
+	}
+}
+
+// WithStateSigningKeys overrides the keys used to sign and encrypt the
+// OAuth state cookie, which default to a random pair generated per
+// OAuthSession. Needed when running more than one instance without
+// sticky sessions.
+func WithStateSigningKeys(hashKey, blockKey []byte) Option {
+	return func(s *OAuthSession) {
+		s.stateCodecs = securecookie.CodecsFromPairs(hashKey, blockKey)
+	}
+}
+
+// IsValidRedirect reports whether target is safe to send a user to after
+// login: a path-only (host-less) URL, the OAuthSession's own redirect
+// host, or a host matching WhitelistDomains.
+func (s *OAuthSession) IsValidRedirect(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+
+	if u.Host == "" {
+		return true
+	}
+
+	if ownURL, err := url.Parse(s.client.RedirectURL); err == nil && strings.EqualFold(u.Hostname(), ownURL.Hostname()) {
+		return true
+	}
+
+	for _, domain := range s.whitelistDomains {
+		if matchesWhitelistDomain(u.Hostname(), domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesWhitelistDomain(host, domain string) bool {
+	host = strings.ToLower(host)
+	domain = strings.ToLower(domain)
+
+	if strings.HasPrefix(domain, ".") {
+		return host == strings.TrimPrefix(domain, ".") || strings.HasSuffix(host, domain)
+	}
+
+	return host == domain
+}
@@ -0,0 +1,98 @@
+package osecure
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testOAuthSessionForState() *OAuthSession {
+	return NewOAuthSession("osecure-test", &OAuthConfig{}, nil, "https://example.com/callback")
+}
+
+func TestMatchesWhitelistDomain(t *testing.T) {
+	cases := []struct {
+		host, domain string
+		want         bool
+	}{
+		{"example.com", "example.com", true},
+		{"EXAMPLE.com", "example.com", true},
+		{"example.com", "EXAMPLE.com", true},
+		{"foo.example.com", ".example.com", true},
+		{"example.com", ".example.com", true},
+		{"evilexample.com", ".example.com", false},
+		{"example.com", "other.com", false},
+	}
+
+	for _, c := range cases {
+		if got := matchesWhitelistDomain(c.host, c.domain); got != c.want {
+			t.Errorf("matchesWhitelistDomain(%q, %q) = %v, want %v", c.host, c.domain, got, c.want)
+		}
+	}
+}
+
+func TestIsValidRedirect(t *testing.T) {
+	s := testOAuthSessionForState()
+	WithWhitelistDomains([]string{".trusted.example"})(s)
+
+	cases := []struct {
+		name   string
+		target string
+		want   bool
+	}{
+		{"path only", "/dashboard", true},
+		{"own host", "https://example.com/after-login", true},
+		{"whitelisted subdomain", "https://sub.trusted.example/ok", true},
+		{"whitelisted domain itself", "https://trusted.example/ok", true},
+		{"untrusted host", "https://evil.example/", false},
+		{"protocol-relative untrusted host", "//evil.example/", false},
+		{"protocol-relative own host", "//example.com/after-login", true},
+	}
+
+	for _, c := range cases {
+		if got := s.IsValidRedirect(c.target); got != c.want {
+			t.Errorf("%s: IsValidRedirect(%q) = %v, want %v", c.name, c.target, got, c.want)
+		}
+	}
+}
+
+func TestVerifyOAuthStateRejectsMismatchAndExpiry(t *testing.T) {
+	s := testOAuthSessionForState()
+
+	issue := func(state oauthState) *http.Cookie {
+		encoded, err := s.encodeOAuthState(state)
+		if err != nil {
+			t.Fatalf("encodeOAuthState: %v", err)
+		}
+		return &http.Cookie{Name: oauthStateCookieName, Value: encoded}
+	}
+
+	fresh := oauthState{Nonce: "the-nonce", OriginalURI: "/after-login", CreatedAt: time.Now()}
+	expired := oauthState{Nonce: "the-nonce", OriginalURI: "/after-login", CreatedAt: time.Now().Add(-2 * oauthStateMaxAge)}
+
+	cases := []struct {
+		name          string
+		cookie        *http.Cookie
+		returnedNonce string
+		wantOK        bool
+	}{
+		{"valid", issue(fresh), "the-nonce", true},
+		{"nonce mismatch", issue(fresh), "wrong-nonce", false},
+		{"expired", issue(expired), "the-nonce", false},
+		{"missing cookie", nil, "the-nonce", false},
+	}
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/callback", nil)
+		if c.cookie != nil {
+			req.AddCookie(c.cookie)
+		}
+
+		_, ok := s.verifyOAuthState(rec, req, c.returnedNonce)
+		if ok != c.wantOK {
+			t.Errorf("%s: verifyOAuthState ok = %v, want %v", c.name, ok, c.wantOK)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package osecure
+
+import (
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+)
+
+func init() {
+	gob.Register(redisTicket{})
+}
+
+// newRandomID returns a random, URL-safe identifier suitable for use as a
+// session id or per-session secret.
+func newRandomID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}